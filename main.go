@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,18 +22,98 @@ import (
 
 const (
 	iopsTablePrefix = "iops-table-"
+
+	containerTablePrefix = "container-device-table-"
+
+	iostatModeBasic    = "basic"
+	iostatModeExtended = "extended"
+
+	cgroupV1 = "v1"
+	cgroupV2 = "v2"
+
+	cgroupV1DockerRoot  = "/sys/fs/cgroup/blkio/docker"
+	cgroupV1SystemSlice = "/sys/fs/cgroup/blkio/system.slice"
+	cgroupV2SystemSlice = "/sys/fs/cgroup/system.slice"
 )
 
+// iostatMode selects between the classic 4-column report (tps, kB_read/s,
+// kB_wrtn/s) and an extended, `iostat -x`-style report, both computed from
+// /proc/diskstats. The extended report shows r/s and w/s in place of the
+// tps and kB/s columns, and adds latency, queue depth and utilization
+// columns. It defaults to "basic" to preserve the
+// existing table layout, and can be set via -iostat-mode or the
+// IOPS_IOSTAT_MODE env var.
+var iostatMode = flag.String("iostat-mode", envOrDefault("IOPS_IOSTAT_MODE", iostatModeBasic),
+	"iostat collection mode: \"basic\" (tps/kB) or \"extended\" (await/queue-depth/%util)")
+
+// sampleInterval controls how often the background sampler re-reads
+// /proc/diskstats. Can be set via -sample-interval or the
+// IOPS_SAMPLE_INTERVAL env var.
+var sampleInterval = flag.Duration("sample-interval", envDurationOrDefault("IOPS_SAMPLE_INTERVAL", time.Second),
+	"interval between /proc/diskstats samples")
+
+// metricsAddr, when non-empty, additionally serves /metrics over TCP so a
+// Prometheus server can scrape this plugin directly. /metrics is always
+// served over the unix socket regardless. Can be set via -metrics-addr or
+// the IOPS_METRICS_ADDR env var.
+var metricsAddr = flag.String("metrics-addr", envOrDefault("IOPS_METRICS_ADDR", ""),
+	"optional host:port to additionally serve /metrics over TCP for Prometheus")
+
+// enableControls gates the quarantine/trim device controls. Disabled by
+// default since they can discard data; enable via -enable-controls or the
+// IOPS_ENABLE_CONTROLS env var.
+var enableControls = flag.Bool("enable-controls", envBoolOrDefault("IOPS_ENABLE_CONTROLS", false),
+	"enable the per-device quarantine/trim controls (disabled by default)")
+
+// controlsAllowDevices is a comma-separated allow-list of device names the
+// quarantine/trim controls may act on. A device not on this list is
+// rejected even when controls are enabled. Can be set via
+// -controls-allow-devices or the IOPS_CONTROLS_ALLOW_DEVICES env var.
+var controlsAllowDevices = flag.String("controls-allow-devices", envOrDefault("IOPS_CONTROLS_ALLOW_DEVICES", ""),
+	"comma-separated allow-list of devices the quarantine/trim controls may act on")
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDurationOrDefault(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func envBoolOrDefault(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
 // Plugin groups the methods a plugin needs
 type Plugin struct {
-	HostID string
+	HostID           string
+	sampler          *sampler
+	containerSampler *containerSampler
+
+	// quarantined holds devices suppressed from reports by the quarantine
+	// control, keyed by device name.
+	quarantined map[string]bool
 
 	lock sync.Mutex
 }
 
 type report struct {
-	Host    topology
-	Plugins []pluginSpec
+	Host      topology
+	Container topology
+	Plugins   []pluginSpec
 }
 
 type topology struct {
@@ -102,6 +185,15 @@ type iopsData struct {
 	Tps     string
 	Readps  string
 	Writeps string
+
+	// Computed by computeRates in every mode, but only reported in
+	// extended mode (see getLatests).
+	Await   float64
+	RAwait  float64
+	WAwait  float64
+	AvgQuSz float64
+	Svctm   float64
+	Util    float64
 }
 
 func setupSocket(socketPath string) (net.Listener, error) {
@@ -129,6 +221,8 @@ func setupSignals(socketPath string) {
 }
 
 func main() {
+	flag.Parse()
+
 	// We put the socket in a sub-directory to have more control on the permissions
 	const socketPath = "/var/run/scope/plugins/iops/iops.sock"
 	hostID, _ := os.Hostname()
@@ -138,12 +232,19 @@ func main() {
 
 	log.Printf("Starting on %s...\n", hostID)
 
-	// Check we can get the iops for the system
-	_, err := iops()
-	if err != nil {
+	// Check we can read disk stats for the system
+	if _, err := readDiskStats(); err != nil {
 		log.Fatal(err)
 	}
 
+	iopsSampler := newSampler(*sampleInterval)
+	go iopsSampler.run()
+
+	cgroupVersion := detectCgroupVersion()
+	log.Printf("Detected cgroup %s, attributing container IO accordingly", cgroupVersion)
+	containerSampler := newContainerSampler(cgroupVersion, *sampleInterval)
+	go containerSampler.run()
+
 	listener, err := setupSocket(socketPath)
 	if err != nil {
 		log.Fatal(err)
@@ -153,10 +254,25 @@ func main() {
 		os.RemoveAll(filepath.Dir(socketPath))
 	}()
 
-	plugin := &Plugin{HostID: hostID}
-	http.HandleFunc("/report", plugin.Report)
-	// http.HandleFunc("/control", plugin.Control)
-	if err := http.Serve(listener, nil); err != nil {
+	plugin := &Plugin{HostID: hostID, sampler: iopsSampler, containerSampler: containerSampler, quarantined: map[string]bool{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", plugin.Report)
+	mux.HandleFunc("/metrics", plugin.Metrics)
+	if *enableControls {
+		mux.HandleFunc("/control", plugin.Control)
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			log.Printf("Serving /metrics on %s", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, http.HandlerFunc(plugin.Metrics)); err != nil {
+				log.Printf("error: metrics listener: %v", err)
+			}
+		}()
+	}
+
+	if err := http.Serve(listener, mux); err != nil {
 		log.Printf("error: %v", err)
 	}
 }
@@ -183,25 +299,235 @@ func (p *Plugin) Report(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
+// diskMetric describes one Prometheus series derived from a device's raw
+// diskStats counters. Names and units follow node_exporter's conventions so
+// existing dashboards and alerts keep working.
+type diskMetric struct {
+	name  string
+	help  string
+	value func(diskStats) float64
+}
+
+var diskMetrics = []diskMetric{
+	{"node_disk_reads_completed_total", "The total number of reads completed successfully.",
+		func(s diskStats) float64 { return float64(s.ReadsCompleted) }},
+	{"node_disk_writes_completed_total", "The total number of writes completed successfully.",
+		func(s diskStats) float64 { return float64(s.WritesCompleted) }},
+	{"node_disk_read_bytes_total", "The total number of bytes read successfully.",
+		func(s diskStats) float64 { return float64(s.SectorsRead) * sectorSize }},
+	{"node_disk_written_bytes_total", "The total number of bytes written successfully.",
+		func(s diskStats) float64 { return float64(s.SectorsWritten) * sectorSize }},
+	{"node_disk_read_time_seconds_total", "The total seconds spent reading.",
+		func(s diskStats) float64 { return float64(s.ReadTicks) / 1000 }},
+	{"node_disk_write_time_seconds_total", "The total seconds spent writing.",
+		func(s diskStats) float64 { return float64(s.WriteTicks) / 1000 }},
+	{"node_disk_io_time_seconds_total", "Total seconds spent doing I/Os.",
+		func(s diskStats) float64 { return float64(s.IOTicks) / 1000 }},
+}
+
+// Metrics exposes the collected per-device diskstats counters in Prometheus
+// text exposition format, labeled by device and host, so the same collector
+// can feed a Prometheus scraper as well as Scope.
+func (p *Plugin) Metrics(w http.ResponseWriter, r *http.Request) {
+	sample := p.sampler.Raw()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if sample == nil {
+		return
+	}
+
+	devices := make([]string, 0, len(sample.Stats))
+	for dev := range sample.Stats {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+
+	for _, m := range diskMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", m.name)
+		for _, dev := range devices {
+			fmt.Fprintf(w, "%s{device=%q,host=%q} %v\n", m.name, dev, p.HostID, m.value(sample.Stats[dev]))
+		}
+	}
+}
+
+const (
+	controlActionQuarantine = "quarantine"
+	controlActionTrim       = "trim"
+)
+
+func quarantineControlID(device string) string {
+	return fmt.Sprintf("%s%s/%s", iopsTablePrefix, device, controlActionQuarantine)
+}
+
+func trimControlID(device string) string {
+	return fmt.Sprintf("%s%s/%s", iopsTablePrefix, device, controlActionTrim)
+}
+
+// parseControlID splits a control ID of the form "iops-table-<device>/<action>"
+// back into its device name and action. The device name is encoded
+// directly rather than as a table row number, so a control always targets
+// the device the operator saw regardless of report churn between the
+// report being rendered and the control being run.
+func parseControlID(id string) (device, action string, err error) {
+	rest := strings.TrimPrefix(id, iopsTablePrefix)
+	if rest == id {
+		return "", "", fmt.Errorf("control: unrecognized control id %q", id)
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("control: unrecognized control id %q", id)
+	}
+	return parts[0], parts[1], nil
+}
+
+type controlRequest struct {
+	NodeID  string `json:"nodeId"`
+	Control string `json:"control"`
+}
+
+type controlResponse struct {
+	ShortcutReport *report `json:"shortcutReport,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// Control is called by scope to run a control previously advertised in a
+// report. It is part of the "controller" interface, which is only
+// advertised (and only registered on the mux) when -enable-controls is set.
+func (p *Plugin) Control(w http.ResponseWriter, r *http.Request) {
+	var req controlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	resp := p.runControl(req.Control)
+
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+// runControl must be called with p.lock held.
+func (p *Plugin) runControl(controlID string) controlResponse {
+	device, action, err := parseControlID(controlID)
+	if err != nil {
+		return controlResponse{Error: err.Error()}
+	}
+
+	if !deviceAllowed(device) {
+		return controlResponse{Error: fmt.Sprintf("control: device %q is not in the controls allow-list", device)}
+	}
+
+	switch action {
+	case controlActionQuarantine:
+		p.quarantined[device] = true
+	case controlActionTrim:
+		if err := trimDevice(device); err != nil {
+			return controlResponse{Error: fmt.Sprintf("control: trim %s: %v", device, err)}
+		}
+	default:
+		return controlResponse{Error: fmt.Sprintf("control: unknown action %q", action)}
+	}
+
+	rpt, err := p.makeReport()
+	if err != nil {
+		return controlResponse{Error: err.Error()}
+	}
+	return controlResponse{ShortcutReport: rpt}
+}
+
+// deviceAllowed reports whether device is on the -controls-allow-devices
+// allow-list. An empty allow-list permits nothing, so controls are a no-op
+// until an operator explicitly opts devices in.
+func deviceAllowed(device string) bool {
+	for _, d := range strings.Split(*controlsAllowDevices, ",") {
+		if strings.TrimSpace(d) == device {
+			return true
+		}
+	}
+	return false
+}
+
+// trimDevice discards unused blocks on device: fstrim if it's mounted,
+// otherwise blkdiscard directly against the block device.
+func trimDevice(device string) error {
+	devPath := "/dev/" + device
+	if mountpoint, ok := findMountpoint(devPath); ok {
+		return exec.Command("fstrim", mountpoint).Run()
+	}
+	return exec.Command("blkdiscard", devPath).Run()
+}
+
+// findMountpoint looks up devPath's mountpoint in /proc/mounts.
+func findMountpoint(devPath string) (string, bool) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == devPath {
+			return fields[1], true
+		}
+	}
+	return "", false
+}
+
 func (p *Plugin) makeReport() (*report, error) {
+	data := p.filteredIopsData()
+
+	controls := map[string]control{}
+	latestControls := map[string]controlEntry{}
+	if *enableControls {
+		ts := time.Now()
+		for _, d := range data {
+			quarantineID, trimID := quarantineControlID(d.Device), trimControlID(d.Device)
+			controls[quarantineID] = control{ID: quarantineID, Human: "Quarantine " + d.Device, Icon: "fa-ban", Rank: 1}
+			controls[trimID] = control{ID: trimID, Human: "Trim " + d.Device, Icon: "fa-eraser", Rank: 2}
+			latestControls[quarantineID] = controlEntry{
+				Timestamp: ts,
+				Value:     controlData{Dead: p.quarantined[d.Device]},
+			}
+		}
+	}
+
+	interfaces := []string{"reporter"}
+	if *enableControls {
+		interfaces = append(interfaces, "controller")
+	}
+
 	rpt := &report{
 		Host: topology{
 			Nodes: map[string]node{
 				p.getTopologyHost(): {
-					LatestControls: map[string]controlEntry{},
-					Latest:         getLatests(),
+					LatestControls: latestControls,
+					Latest:         p.getLatests(data),
 				},
 			},
-			Controls:          map[string]control{},
+			Controls:          controls,
 			MetadataTemplates: getMetadataTemplate(),
 			TableTemplates:    getTableTemplate(),
 		},
+		Container: p.makeContainerTopology(),
 		Plugins: []pluginSpec{
 			{
 				ID:          "iops",
 				Label:       "iops",
 				Description: "Adds a IOPS details to Host",
-				Interfaces:  []string{"reporter"},
+				Interfaces:  interfaces,
 				APIVersion:  "1",
 			},
 		},
@@ -209,86 +535,289 @@ func (p *Plugin) makeReport() (*report, error) {
 	return rpt, nil
 }
 
-func iops() ([]iopsData, error) {
-	return iostat()
+// filteredIopsData returns the latest sampled per-device rates with any
+// quarantined devices removed.
+func (p *Plugin) filteredIopsData() []iopsData {
+	all := p.sampler.Latest()
+	if len(p.quarantined) == 0 {
+		return all
+	}
+
+	filtered := make([]iopsData, 0, len(all))
+	for _, d := range all {
+		if p.quarantined[d.Device] {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
 }
 
-// Get the latest iostat values
-func iostat() ([]iopsData, error) {
-	out, err := exec.Command("iostat", "-d").Output()
+// sectorSize is the fixed 512-byte unit that /proc/diskstats reports sector
+// counts in, regardless of the device's actual block size. See
+// Documentation/admin-guide/iostats.rst in the kernel tree.
+const sectorSize = 512
+
+// diskStats is one device's raw, monotonically increasing counters as read
+// from /proc/diskstats.
+type diskStats struct {
+	ReadsCompleted  uint64
+	SectorsRead     uint64
+	ReadTicks       uint64 // milliseconds
+	WritesCompleted uint64
+	SectorsWritten  uint64
+	WriteTicks      uint64 // milliseconds
+	IOTicks         uint64 // milliseconds
+	WeightedIOTicks uint64 // milliseconds
+}
+
+// diskSample is a snapshot of every device's counters at a point in time.
+type diskSample struct {
+	Timestamp time.Time
+	Stats     map[string]diskStats
+}
+
+// readDiskStats parses /proc/diskstats. Each line has the form:
+//
+//	major minor name rd_ios rd_merges rd_sectors rd_ticks \
+//	  wr_ios wr_merges wr_sectors wr_ticks ios_in_progress tot_ticks rq_ticks
+func readDiskStats() (*diskSample, error) {
+	f, err := os.Open("/proc/diskstats")
 	if err != nil {
-		return nil, fmt.Errorf("iops: %v", err)
+		return nil, fmt.Errorf("diskstats: %v", err)
 	}
+	defer f.Close()
+
+	sample := &diskSample{Timestamp: time.Now(), Stats: map[string]diskStats{}}
 
-	// Linux 4.2.0-25-generic (a109563eab38)	04/01/16	_x86_64_(4 CPU)
-	//
-	// avg-cpu:  %user   %nice %system %iowait  %steal   %idle
-	//	          2.37    0.00    1.58    0.01    0.00   96.04
-	lines := strings.Split(string(out), "\n")
-	if len(lines) < 3 {
-		return nil, fmt.Errorf("iops: unexpected output: %q", out)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		sample.Stats[fields[2]] = diskStats{
+			ReadsCompleted:  parseUintOrZero(fields[3]),
+			SectorsRead:     parseUintOrZero(fields[5]),
+			ReadTicks:       parseUintOrZero(fields[6]),
+			WritesCompleted: parseUintOrZero(fields[7]),
+			SectorsWritten:  parseUintOrZero(fields[9]),
+			WriteTicks:      parseUintOrZero(fields[10]),
+			IOTicks:         parseUintOrZero(fields[12]),
+			WeightedIOTicks: parseUintOrZero(fields[13]),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("diskstats: %v", err)
 	}
+	return sample, nil
+}
+
+// sampler periodically reads /proc/diskstats in the background and keeps the
+// latest computed per-device rates available for concurrent reads, so that
+// Plugin.Report never has to shell out or block on I/O.
+type sampler struct {
+	interval time.Duration
 
-	iops := make([]iopsData, len(lines)-3)
-	var i = 0
+	mu     sync.RWMutex
+	prev   *diskSample
+	latest []iopsData
+}
+
+func newSampler(interval time.Duration) *sampler {
+	return &sampler{interval: interval}
+}
 
-	for index, line := range lines {
-		if line == "" && index != 1 {
-			break
+// run takes an initial sample and then one every interval, computing rates
+// against the previous sample as it goes. It blocks forever and is meant to
+// be started with `go`.
+func (s *sampler) run() {
+	if err := s.sampleOnce(); err != nil {
+		log.Printf("diskstats: %v", err)
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.sampleOnce(); err != nil {
+			log.Printf("diskstats: %v", err)
+		}
+	}
+}
+
+func (s *sampler) sampleOnce() error {
+	cur, err := readDiskStats()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prev != nil {
+		s.latest = computeRates(s.prev, cur)
+	}
+	s.prev = cur
+	return nil
+}
+
+// Latest returns the most recently computed per-device rates. It is safe
+// for concurrent use.
+func (s *sampler) Latest() []iopsData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latest
+}
+
+// Raw returns the most recently read cumulative diskstats snapshot, for
+// consumers (like the Prometheus /metrics endpoint) that want counters
+// rather than derived rates. It is safe for concurrent use.
+func (s *sampler) Raw() *diskSample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.prev
+}
+
+// computeRates derives per-device rates between two diskstats snapshots
+// using the standard sysstat formulas:
+//
+//	tps    = (rd_ios+wr_ios)/dt
+//	%util  = (io_ticks/1000)/dt * 100
+//	await  = (rd_ticks+wr_ticks)/(rd_ios+wr_ios)
+func computeRates(prev, cur *diskSample) []iopsData {
+	dt := cur.Timestamp.Sub(prev.Timestamp).Seconds()
+	if dt <= 0 {
+		return nil
+	}
+
+	devices := make([]string, 0, len(cur.Stats))
+	for dev := range cur.Stats {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+
+	data := make([]iopsData, 0, len(devices))
+	for _, dev := range devices {
+		c := cur.Stats[dev]
+		p, ok := prev.Stats[dev]
+		if !ok {
+			continue
 		}
-		if index > 2 {
-			values := strings.Fields(line)
-			iops[i].Device = values[0]
-			iops[i].Tps = values[1]
-			iops[i].Readps = values[2]
-			iops[i].Writeps = values[3]
-			i++
+
+		rdIOs := diffUint64(c.ReadsCompleted, p.ReadsCompleted)
+		wrIOs := diffUint64(c.WritesCompleted, p.WritesCompleted)
+		rdSectors := diffUint64(c.SectorsRead, p.SectorsRead)
+		wrSectors := diffUint64(c.SectorsWritten, p.SectorsWritten)
+		rdTicks := diffUint64(c.ReadTicks, p.ReadTicks)
+		wrTicks := diffUint64(c.WriteTicks, p.WriteTicks)
+		ioTicks := diffUint64(c.IOTicks, p.IOTicks)
+		weightedTicks := diffUint64(c.WeightedIOTicks, p.WeightedIOTicks)
+
+		rps := float64(rdIOs) / dt
+		wps := float64(wrIOs) / dt
+		readKBps := float64(rdSectors) * sectorSize / 1024 / dt
+		writeKBps := float64(wrSectors) * sectorSize / 1024 / dt
+		totalIOs := rdIOs + wrIOs
+
+		d := iopsData{
+			Device: dev,
+			Tps:    formatFloat(rps + wps),
+			Util:   float64(ioTicks) / 1000 / dt * 100,
+		}
+		if totalIOs > 0 {
+			d.Await = float64(rdTicks+wrTicks) / float64(totalIOs)
+			d.Svctm = float64(ioTicks) / float64(totalIOs)
+			d.AvgQuSz = float64(weightedTicks) / 1000 / dt
+		}
+		if rdIOs > 0 {
+			d.RAwait = float64(rdTicks) / float64(rdIOs)
+		}
+		if wrIOs > 0 {
+			d.WAwait = float64(wrTicks) / float64(wrIOs)
 		}
+
+		if *iostatMode == iostatModeExtended {
+			d.Readps = formatFloat(rps)
+			d.Writeps = formatFloat(wps)
+		} else {
+			d.Readps = formatFloat(readKBps)
+			d.Writeps = formatFloat(writeKBps)
+		}
+
+		data = append(data, d)
 	}
 
-	if len(iops) <= 0 {
-		return nil, fmt.Errorf("iops: unexpected output: %q", out)
+	return data
+}
+
+func diffUint64(cur, prev uint64) uint64 {
+	if cur < prev {
+		return 0
 	}
-	return iops, nil
+	return cur - prev
+}
+
+func parseUintOrZero(s string) uint64 {
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
 }
 
 func (p *Plugin) getTopologyHost() string {
 	return fmt.Sprintf("%s;<host>", p.HostID)
 }
 
-func getLatests() map[string]stringEntry {
+func (p *Plugin) getLatests(IopsData []iopsData) map[string]stringEntry {
 	ts := time.Now()
-	IopsData, err := iops()
-	if err != nil {
-		return nil
-	}
 
 	latests := map[string]stringEntry{}
 
 	for index, value := range IopsData {
-		latests["iops-table-"+strconv.Itoa(index+1)+"___device"] = stringEntry{
+		prefix := "iops-table-" + strconv.Itoa(index+1) + "___"
+		latests[prefix+"device"] = stringEntry{
 			Timestamp: ts,
 			Value:     value.Device,
 		}
-		latests["iops-table-"+strconv.Itoa(index+1)+"___tps"] = stringEntry{
-			Timestamp: ts,
-			Value:     value.Tps,
-		}
-		latests["iops-table-"+strconv.Itoa(index+1)+"___readps"] = stringEntry{
+		latests[prefix+"readps"] = stringEntry{
 			Timestamp: ts,
 			Value:     value.Readps,
 		}
-		latests["iops-table-"+strconv.Itoa(index+1)+"___writeps"] = stringEntry{
+		latests[prefix+"writeps"] = stringEntry{
 			Timestamp: ts,
 			Value:     value.Writeps,
 		}
+
+		if *iostatMode == iostatModeExtended {
+			latests[prefix+"await"] = stringEntry{Timestamp: ts, Value: formatFloat(value.Await)}
+			latests[prefix+"r_await"] = stringEntry{Timestamp: ts, Value: formatFloat(value.RAwait)}
+			latests[prefix+"w_await"] = stringEntry{Timestamp: ts, Value: formatFloat(value.WAwait)}
+			latests[prefix+"avgqu_sz"] = stringEntry{Timestamp: ts, Value: formatFloat(value.AvgQuSz)}
+			latests[prefix+"svctm"] = stringEntry{Timestamp: ts, Value: formatFloat(value.Svctm)}
+			latests[prefix+"util"] = stringEntry{Timestamp: ts, Value: formatFloat(value.Util)}
+			continue
+		}
+
+		latests[prefix+"tps"] = stringEntry{
+			Timestamp: ts,
+			Value:     value.Tps,
+		}
 	}
 
 	return latests
 }
 
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
 func getMetadataTemplate() map[string]metadataTemplate {
-	return map[string]metadataTemplate{
+	readpsLabel, writepsLabel := "kB_read/s", "kB_wrtn/s"
+	if *iostatMode == iostatModeExtended {
+		readpsLabel, writepsLabel = "r/s", "w/s"
+	}
+
+	templates := map[string]metadataTemplate{
 		"device": {
 			ID:       "device",
 			Label:    "Device",
@@ -297,17 +826,9 @@ func getMetadataTemplate() map[string]metadataTemplate {
 			Priority: 1,
 			From:     "latest",
 		},
-		"tps": {
-			ID:       "tps",
-			Label:    "tps",
-			Truncate: 0,
-			Datatype: "",
-			Priority: 1,
-			From:     "latest",
-		},
 		"readps": {
 			ID:       "readps",
-			Label:    "kB_read/s",
+			Label:    readpsLabel,
 			Truncate: 0,
 			Datatype: "",
 			Priority: 1,
@@ -315,44 +836,526 @@ func getMetadataTemplate() map[string]metadataTemplate {
 		},
 		"writeps": {
 			ID:       "writeps",
-			Label:    "kB_wrtn/s",
+			Label:    writepsLabel,
 			Truncate: 0,
 			Datatype: "",
 			Priority: 1,
 			From:     "latest",
 		},
 	}
+
+	if *iostatMode == iostatModeExtended {
+		for id, label := range extendedColumnLabels() {
+			templates[id] = metadataTemplate{
+				ID:       id,
+				Label:    label,
+				Truncate: 0,
+				Datatype: "",
+				Priority: 1,
+				From:     "latest",
+			}
+		}
+		return templates
+	}
+
+	templates["tps"] = metadataTemplate{
+		ID:       "tps",
+		Label:    "tps",
+		Truncate: 0,
+		Datatype: "",
+		Priority: 1,
+		From:     "latest",
+	}
+	return templates
 }
 
 func getTableTemplate() map[string]tableTemplate {
+	readpsLabel, writepsLabel := "kB_read/s", "kB_wrtn/s"
+	if *iostatMode == iostatModeExtended {
+		readpsLabel, writepsLabel = "r/s", "w/s"
+	}
+
+	cols := []columns{
+		{ID: "device", Label: "Device", Datatype: ""},
+	}
+
+	if *iostatMode == iostatModeExtended {
+		cols = append(cols, columns{ID: "readps", Label: readpsLabel, Datatype: ""})
+		cols = append(cols, columns{ID: "writeps", Label: writepsLabel, Datatype: ""})
+		for _, id := range []string{"await", "r_await", "w_await", "avgqu_sz", "svctm", "util"} {
+			cols = append(cols, columns{ID: id, Label: extendedColumnLabels()[id], Datatype: ""})
+		}
+	} else {
+		cols = append(cols, columns{ID: "tps", Label: "tps", Datatype: ""})
+		cols = append(cols, columns{ID: "readps", Label: readpsLabel, Datatype: ""})
+		cols = append(cols, columns{ID: "writeps", Label: writepsLabel, Datatype: ""})
+	}
+
 	return map[string]tableTemplate{
 		"iops-table-": {
-			ID:     "iops-table-",
-			Label:  "Iops",
-			Prefix: iopsTablePrefix,
+			ID:      "iops-table-",
+			Label:   "Iops",
+			Prefix:  iopsTablePrefix,
+			Type:    "multicolumn-table",
+			Columns: cols,
+		},
+	}
+}
+
+// extendedColumnLabels maps the extended-mode latency/queue/utilization
+// column IDs to their human-readable labels.
+func extendedColumnLabels() map[string]string {
+	return map[string]string{
+		"await":    "await (ms)",
+		"r_await":  "r_await (ms)",
+		"w_await":  "w_await (ms)",
+		"avgqu_sz": "avgqu-sz",
+		"svctm":    "svctm (ms)",
+		"util":     "%util",
+	}
+}
+
+// makeContainerTopology builds the "container" topology, attributing the
+// latest per-container device IO rates to one node per container so that
+// Scope can surface container-level IO hotspots alongside the host view.
+func (p *Plugin) makeContainerTopology() topology {
+	containers := p.containerSampler.Latest()
+
+	ids := make([]string, 0, len(containers))
+	for id := range containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	nodes := make(map[string]node, len(ids))
+	for _, id := range ids {
+		nodes[containerNodeID(id)] = node{Latest: getContainerLatests(containers[id])}
+	}
+
+	return topology{
+		Nodes:             nodes,
+		Controls:          map[string]control{},
+		MetadataTemplates: getContainerMetadataTemplate(),
+		TableTemplates:    getContainerTableTemplate(),
+	}
+}
+
+// containerNodeID builds a Scope node ID for a container, following the same
+// "<id>;<type>" convention Scope's own container topology uses.
+func containerNodeID(id string) string {
+	return fmt.Sprintf("%s;<container>", id)
+}
+
+func getContainerLatests(rows []containerIopsData) map[string]stringEntry {
+	ts := time.Now()
+
+	latests := map[string]stringEntry{}
+	for index, value := range rows {
+		prefix := containerTablePrefix + strconv.Itoa(index+1) + "___"
+		latests[prefix+"device"] = stringEntry{Timestamp: ts, Value: value.Device}
+		latests[prefix+"read_bytesps"] = stringEntry{Timestamp: ts, Value: value.ReadBytesps}
+		latests[prefix+"write_bytesps"] = stringEntry{Timestamp: ts, Value: value.WriteBytesps}
+		latests[prefix+"readps"] = stringEntry{Timestamp: ts, Value: value.Readps}
+		latests[prefix+"writeps"] = stringEntry{Timestamp: ts, Value: value.Writeps}
+	}
+	return latests
+}
+
+func getContainerMetadataTemplate() map[string]metadataTemplate {
+	return map[string]metadataTemplate{
+		"device":        {ID: "device", Label: "Device", Priority: 1, From: "latest"},
+		"read_bytesps":  {ID: "read_bytesps", Label: "read B/s", Priority: 1, From: "latest"},
+		"write_bytesps": {ID: "write_bytesps", Label: "write B/s", Priority: 1, From: "latest"},
+		"readps":        {ID: "readps", Label: "r/s", Priority: 1, From: "latest"},
+		"writeps":       {ID: "writeps", Label: "w/s", Priority: 1, From: "latest"},
+	}
+}
+
+func getContainerTableTemplate() map[string]tableTemplate {
+	return map[string]tableTemplate{
+		"container-device-table-": {
+			ID:     "container-device-table-",
+			Label:  "Device IO",
+			Prefix: containerTablePrefix,
 			Type:   "multicolumn-table",
 			Columns: []columns{
-				{
-					ID:       "device",
-					Label:    "Device",
-					Datatype: "",
-				},
-				{
-					ID:       "tps",
-					Label:    "tps",
-					Datatype: "",
-				},
-				{
-					ID:       "readps",
-					Label:    "kB_read/s",
-					Datatype: "",
-				},
-				{
-					ID:       "writeps",
-					Label:    "kB_wrtn/s",
-					Datatype: "",
-				},
+				{ID: "device", Label: "Device"},
+				{ID: "read_bytesps", Label: "read B/s"},
+				{ID: "write_bytesps", Label: "write B/s"},
+				{ID: "readps", Label: "r/s"},
+				{ID: "writeps", Label: "w/s"},
 			},
 		},
 	}
 }
+
+// containerDeviceStats is one container's raw, monotonically increasing
+// per-device blkio counters, read from either cgroup v1's
+// blkio.throttle.io_service_bytes/io_serviced or cgroup v2's io.stat.
+type containerDeviceStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+}
+
+// containerSnapshot is a snapshot of every container's per-device counters
+// at a point in time, keyed by container ID then device name.
+type containerSnapshot struct {
+	Timestamp time.Time
+	Devices   map[string]map[string]containerDeviceStats
+}
+
+// containerIopsData is one container/device pair's computed IO rates,
+// ready to be rendered into a container-device-table row.
+type containerIopsData struct {
+	Device       string
+	ReadBytesps  string
+	WriteBytesps string
+	Readps       string
+	Writeps      string
+}
+
+// detectCgroupVersion picks v2 when the unified hierarchy is mounted
+// (presence of cgroup.controllers), and falls back to v1's separate blkio
+// controller otherwise.
+func detectCgroupVersion() string {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		return cgroupV2
+	}
+	return cgroupV1
+}
+
+// deviceNamesByDevNo maps "<major>:<minor>" device numbers, as used by the
+// blkio/io.stat controllers, back to device names like "sda" using
+// /proc/diskstats.
+func deviceNamesByDevNo() map[string]string {
+	f, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	names := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		names[fields[0]+":"+fields[1]] = fields[2]
+	}
+	return names
+}
+
+// containerSampler periodically walks the cgroup blkio hierarchy in the
+// background and keeps the latest computed per-container, per-device IO
+// rates available for concurrent reads, mirroring how sampler does it for
+// host-level /proc/diskstats.
+type containerSampler struct {
+	version  string
+	interval time.Duration
+
+	mu     sync.RWMutex
+	prev   *containerSnapshot
+	latest map[string][]containerIopsData
+}
+
+func newContainerSampler(version string, interval time.Duration) *containerSampler {
+	return &containerSampler{version: version, interval: interval}
+}
+
+// run takes an initial sample and then one every interval, computing rates
+// against the previous sample as it goes. It blocks forever and is meant to
+// be started with `go`.
+func (s *containerSampler) run() {
+	if err := s.sampleOnce(); err != nil {
+		log.Printf("container diskstats: %v", err)
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.sampleOnce(); err != nil {
+			log.Printf("container diskstats: %v", err)
+		}
+	}
+}
+
+func (s *containerSampler) sampleOnce() error {
+	cur, err := readContainerStats(s.version)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prev != nil {
+		s.latest = computeContainerRates(s.prev, cur)
+	}
+	s.prev = cur
+	return nil
+}
+
+// Latest returns the most recently computed per-container device rates,
+// keyed by container ID. It is safe for concurrent use.
+func (s *containerSampler) Latest() map[string][]containerIopsData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latest
+}
+
+// readContainerStats reads every container's cumulative blkio counters
+// using the path layout for the given cgroup version. A host with no
+// running containers (or no docker cgroup at all) is not an error: it just
+// yields an empty snapshot.
+func readContainerStats(version string) (*containerSnapshot, error) {
+	if version == cgroupV2 {
+		return readContainerStatsV2()
+	}
+	return readContainerStatsV1()
+}
+
+// readContainerStatsV1 reads container blkio stats under whichever v1
+// layout this host's docker actually uses: the flat cgroupfs-driver layout
+// (blkio/docker/<id>), or, when docker runs under the systemd cgroup
+// driver, containers nested under blkio/system.slice/docker-<id>.scope, the
+// same slice naming v2's readContainerStatsV2 already expects.
+func readContainerStatsV1() (*containerSnapshot, error) {
+	snapshot := &containerSnapshot{Timestamp: time.Now(), Devices: map[string]map[string]containerDeviceStats{}}
+	devNames := deviceNamesByDevNo()
+
+	if entries, err := os.ReadDir(cgroupV1DockerRoot); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			id := entry.Name()
+			readContainerBlkioDir(filepath.Join(cgroupV1DockerRoot, id), id, devNames, snapshot)
+		}
+		return snapshot, nil
+	}
+
+	if entries, err := os.ReadDir(cgroupV1SystemSlice); err == nil {
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() || !strings.HasPrefix(name, "docker-") || !strings.HasSuffix(name, ".scope") {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(name, "docker-"), ".scope")
+			readContainerBlkioDir(filepath.Join(cgroupV1SystemSlice, name), id, devNames, snapshot)
+		}
+		return snapshot, nil
+	}
+
+	warnCgroupV1RootMissing()
+	return snapshot, nil
+}
+
+// readContainerBlkioDir parses one container's blkio.throttle.* files under
+// dir and, if readable, records its per-device stats into snapshot keyed by
+// id.
+func readContainerBlkioDir(dir, id string, devNames map[string]string, snapshot *containerSnapshot) {
+	stats, err := parseBlkioServiceBytes(filepath.Join(dir, "blkio.throttle.io_service_bytes"), devNames)
+	if err != nil {
+		return
+	}
+	mergeBlkioServiced(stats, filepath.Join(dir, "blkio.throttle.io_serviced"), devNames)
+	snapshot.Devices[id] = stats
+}
+
+// cgroupV1RootWarnOnce ensures the missing-docker-cgroup warning is logged
+// once rather than on every sample interval.
+var cgroupV1RootWarnOnce sync.Once
+
+func warnCgroupV1RootMissing() {
+	cgroupV1RootWarnOnce.Do(func() {
+		log.Printf("container diskstats: no docker blkio cgroup found at %s or %s; container IO attribution will stay empty",
+			cgroupV1DockerRoot, cgroupV1SystemSlice)
+	})
+}
+
+func readContainerStatsV2() (*containerSnapshot, error) {
+	snapshot := &containerSnapshot{Timestamp: time.Now(), Devices: map[string]map[string]containerDeviceStats{}}
+
+	entries, err := os.ReadDir(cgroupV2SystemSlice)
+	if err != nil {
+		return snapshot, nil
+	}
+
+	devNames := deviceNamesByDevNo()
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, "docker-") || !strings.HasSuffix(name, ".scope") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, "docker-"), ".scope")
+
+		stats, err := parseIOStat(filepath.Join(cgroupV2SystemSlice, name, "io.stat"), devNames)
+		if err != nil {
+			continue
+		}
+		snapshot.Devices[id] = stats
+	}
+	return snapshot, nil
+}
+
+// parseBlkioServiceBytes parses a cgroup v1 blkio.throttle.io_service_bytes
+// file, whose lines look like "<major>:<minor> Read <bytes>" / "... Write
+// <bytes>", plus a trailing "Total <bytes>" line we skip.
+func parseBlkioServiceBytes(path string, devNames map[string]string) (map[string]containerDeviceStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := map[string]containerDeviceStats{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		dev := deviceName(fields[0], devNames)
+		s := stats[dev]
+		switch fields[1] {
+		case "Read":
+			s.ReadBytes = parseUintOrZero(fields[2])
+		case "Write":
+			s.WriteBytes = parseUintOrZero(fields[2])
+		default:
+			continue
+		}
+		stats[dev] = s
+	}
+	return stats, scanner.Err()
+}
+
+// mergeBlkioServiced folds the IO operation counts from a cgroup v1
+// blkio.throttle.io_serviced file into stats, which must already be keyed by
+// the same device names.
+func mergeBlkioServiced(stats map[string]containerDeviceStats, path string, devNames map[string]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		dev := deviceName(fields[0], devNames)
+		s := stats[dev]
+		switch fields[1] {
+		case "Read":
+			s.ReadOps = parseUintOrZero(fields[2])
+		case "Write":
+			s.WriteOps = parseUintOrZero(fields[2])
+		default:
+			continue
+		}
+		stats[dev] = s
+	}
+}
+
+// parseIOStat parses a cgroup v2 io.stat file, whose lines look like
+// "<major>:<minor> rbytes=1 wbytes=2 rios=3 wios=4 dbytes=5 dios=6".
+func parseIOStat(path string, devNames map[string]string) (map[string]containerDeviceStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := map[string]containerDeviceStats{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		dev := deviceName(fields[0], devNames)
+		var s containerDeviceStats
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			val := parseUintOrZero(parts[1])
+			switch parts[0] {
+			case "rbytes":
+				s.ReadBytes = val
+			case "wbytes":
+				s.WriteBytes = val
+			case "rios":
+				s.ReadOps = val
+			case "wios":
+				s.WriteOps = val
+			}
+		}
+		stats[dev] = s
+	}
+	return stats, scanner.Err()
+}
+
+// deviceName resolves a "<major>:<minor>" device number to its device name,
+// falling back to the raw number if /proc/diskstats has no matching entry.
+func deviceName(devNo string, devNames map[string]string) string {
+	if name, ok := devNames[devNo]; ok {
+		return name
+	}
+	return devNo
+}
+
+// computeContainerRates derives per-container, per-device IO rates between
+// two snapshots using the same diff-over-dt approach as computeRates.
+func computeContainerRates(prev, cur *containerSnapshot) map[string][]containerIopsData {
+	dt := cur.Timestamp.Sub(prev.Timestamp).Seconds()
+	if dt <= 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(cur.Devices))
+	for id := range cur.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := map[string][]containerIopsData{}
+	for _, id := range ids {
+		prevDevices, ok := prev.Devices[id]
+		if !ok {
+			continue
+		}
+
+		devices := make([]string, 0, len(cur.Devices[id]))
+		for dev := range cur.Devices[id] {
+			devices = append(devices, dev)
+		}
+		sort.Strings(devices)
+
+		var rows []containerIopsData
+		for _, dev := range devices {
+			c := cur.Devices[id][dev]
+			p, ok := prevDevices[dev]
+			if !ok {
+				continue
+			}
+			rows = append(rows, containerIopsData{
+				Device:       dev,
+				ReadBytesps:  formatFloat(float64(diffUint64(c.ReadBytes, p.ReadBytes)) / dt),
+				WriteBytesps: formatFloat(float64(diffUint64(c.WriteBytes, p.WriteBytes)) / dt),
+				Readps:       formatFloat(float64(diffUint64(c.ReadOps, p.ReadOps)) / dt),
+				Writeps:      formatFloat(float64(diffUint64(c.WriteOps, p.WriteOps)) / dt),
+			})
+		}
+		if len(rows) > 0 {
+			result[id] = rows
+		}
+	}
+	return result
+}